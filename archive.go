@@ -0,0 +1,374 @@
+// Copyright 2018 State of New South Wales through the State Archives and Records Authority of NSW
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wincommands
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveEntry describes one regular file inside an archive passed to
+// WalkArchive. Name is forward-slash-separated and has already been
+// validated not to escape the archive root.
+type ArchiveEntry struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+type archiveKind int
+
+const (
+	archiveNone archiveKind = iota
+	archiveZip
+	archiveTar
+	archiveTarGz
+	archiveTarXz
+)
+
+func kindOf(input string) archiveKind {
+	lower := strings.ToLower(input)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(lower, ".tar.xz"), strings.HasSuffix(lower, ".txz"):
+		return archiveTarXz
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	}
+	return archiveNone
+}
+
+// tarMagicOffset and tarMagicLen locate the "ustar" magic in a tar header,
+// used by sniffKind to recognise a plain .tar by content.
+const (
+	tarMagicOffset = 257
+	tarMagicLen    = 5
+)
+
+// sniffKind identifies input's archive kind from its leading signature
+// bytes, for input whose extension doesn't already identify it via kindOf -
+// e.g. a browser or ingest upload that arrives without (or with the wrong)
+// extension. It recognises zip (PK\x03\x04), gzip (\x1f\x8b), and plain tar
+// (the "ustar" magic at offset 257). It returns archiveNone if input can't
+// be opened or none of those signatures match.
+func sniffKind(input string) archiveKind {
+	f, err := os.Open(input)
+	if err != nil {
+		return archiveNone
+	}
+	defer f.Close()
+	header := make([]byte, tarMagicOffset+tarMagicLen)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return archiveZip
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return archiveTarGz
+	case len(header) == cap(header) && string(header[tarMagicOffset:tarMagicOffset+tarMagicLen]) == "ustar":
+		return archiveTar
+	}
+	return archiveNone
+}
+
+// detectKind identifies input's archive kind by extension, falling back to
+// sniffKind when the extension doesn't match.
+func detectKind(input string) archiveKind {
+	if k := kindOf(input); k != archiveNone {
+		return k
+	}
+	return sniffKind(input)
+}
+
+// IsArchive reports whether input is an archive WalkArchive and
+// ExtractArchive can handle: .zip, .tar, .tar.gz/.tgz, or .tar.xz. Input is
+// identified by extension first, falling back to a signature-byte sniff for
+// input whose extension doesn't match.
+func IsArchive(input string) bool {
+	return detectKind(input) != archiveNone
+}
+
+// xzDecoder, if set, is used to decompress .tar.xz archives. The standard
+// library has no xz support, so WalkArchive and ExtractArchive refuse
+// .tar.xz input until a caller registers one with SetXZDecoder, e.g.
+// wrapping github.com/ulikunitz/xz.NewReader.
+var xzDecoder func(io.Reader) (io.Reader, error)
+
+// SetXZDecoder registers the decompressor used to read .tar.xz archives.
+func SetXZDecoder(f func(io.Reader) (io.Reader, error)) {
+	xzDecoder = f
+}
+
+// WalkArchive calls fn once for each regular file in input, in archive
+// order, passing a reader positioned at the start of that file's content.
+// The reader is only valid for the duration of the call. Entries are
+// rejected - and WalkArchive returns an error - if their path is absolute,
+// climbs above the archive root via "..", or (for tar or zip symlinks)
+// resolves outside the archive root, mirroring the hardening in Docker's
+// pkg/archive.
+func WalkArchive(ctx context.Context, input string, fn func(ArchiveEntry, io.Reader) error) error {
+	switch kind := detectKind(input); kind {
+	case archiveZip:
+		return walkZip(ctx, input, fn)
+	case archiveTar, archiveTarGz, archiveTarXz:
+		return walkTar(ctx, input, kind, fn)
+	}
+	return fmt.Errorf("Commands: Error walking archive %s, error message: unrecognised archive type", input)
+}
+
+func walkZip(ctx context.Context, input string, fn func(ArchiveEntry, io.Reader) error) error {
+	zr, err := zip.OpenReader(input)
+	if err != nil {
+		return fmt.Errorf("Commands: Error opening zip archive %s, error message: %v", input, err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name, err := safeArchiveName(f.Name)
+		if err != nil {
+			return fmt.Errorf("Commands: Error in zip archive %s, error message: %v", input, err)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("Commands: Error reading %s from zip archive %s, error message: %v", f.Name, input, err)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("Commands: Error reading symlink target for %s from zip archive %s, error message: %v", f.Name, input, err)
+			}
+			if err := safeArchiveLink(name, string(target)); err != nil {
+				return fmt.Errorf("Commands: Error in zip archive %s, error message: %v", input, err)
+			}
+			continue // links are validated but not materialised, as in walkTar
+		}
+		err = fn(ArchiveEntry{Name: name, Mode: f.Mode(), Size: int64(f.UncompressedSize64), ModTime: f.Modified}, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(ctx context.Context, input string, kind archiveKind, fn func(ArchiveEntry, io.Reader) error) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("Commands: Error opening archive %s, error message: %v", input, err)
+	}
+	defer f.Close()
+	r, err := tarReaderFor(input, kind, f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Commands: Error reading archive %s, error message: %v", input, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue // directories are skipped before validation, as in walkZip
+		}
+		name, err := safeArchiveName(hdr.Name)
+		if err != nil {
+			return fmt.Errorf("Commands: Error in archive %s, error message: %v", input, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			if err := safeArchiveLink(name, hdr.Linkname); err != nil {
+				return fmt.Errorf("Commands: Error in archive %s, error message: %v", input, err)
+			}
+			continue // links are validated but not materialised
+		case tar.TypeReg:
+			if err := fn(ArchiveEntry{Name: name, Mode: os.FileMode(hdr.Mode), Size: hdr.Size, ModTime: hdr.ModTime}, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func tarReaderFor(input string, kind archiveKind, f *os.File) (io.Reader, error) {
+	switch kind {
+	case archiveTarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("Commands: Error opening gzip archive %s, error message: %v", input, err)
+		}
+		return gz, nil
+	case archiveTarXz:
+		if xzDecoder == nil {
+			return nil, fmt.Errorf("Commands: Error opening archive %s, error message: no xz decoder registered, see SetXZDecoder", input)
+		}
+		xr, err := xzDecoder(f)
+		if err != nil {
+			return nil, fmt.Errorf("Commands: Error opening xz archive %s, error message: %v", input, err)
+		}
+		return xr, nil
+	}
+	return f, nil
+}
+
+// safeArchiveName cleans an archive entry's path and rejects one that is
+// absolute or that climbs above the archive root via "..".
+func safeArchiveName(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	if clean == "." || clean == "" {
+		return "", fmt.Errorf("entry %q has an empty name", name)
+	}
+	if path.IsAbs(clean) {
+		return "", fmt.Errorf("entry %q has an absolute path", name)
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("entry %q escapes the archive root", name)
+	}
+	return clean, nil
+}
+
+// safeArchiveLink rejects a symlink (or hardlink) whose target, resolved
+// relative to name, escapes the archive root.
+func safeArchiveLink(name, target string) error {
+	if target == "" {
+		return nil
+	}
+	target = strings.ReplaceAll(target, `\`, "/")
+	resolved := target
+	if !path.IsAbs(target) {
+		resolved = path.Join(path.Dir(name), target)
+	}
+	resolved = path.Clean(resolved)
+	if path.IsAbs(resolved) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("link %q -> %q escapes the archive root", name, target)
+	}
+	return nil
+}
+
+// ExtractArchive extracts every regular file in input (a .zip, .tar,
+// .tar.gz/.tgz, or .tar.xz archive) into outdir, recreating the archive's
+// internal directory structure and preserving each entry's mode and mtime.
+func ExtractArchive(ctx context.Context, input, outdir string) error {
+	if err, _ := MakeDir(outdir); err != nil {
+		return err
+	}
+	return WalkArchive(ctx, input, func(entry ArchiveEntry, r io.Reader) error {
+		dest := filepath.Join(outdir, filepath.FromSlash(entry.Name))
+		if err, _ := MakeDir(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		mode := entry.Mode
+		if mode == 0 {
+			mode = os.ModePerm
+		}
+		out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return fmt.Errorf("Commands: Error creating %s, error message: %v", dest, err)
+		}
+		_, err = io.Copy(out, r)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("Commands: Error extracting %s, error message: %v", dest, err)
+		}
+		if !entry.ModTime.IsZero() {
+			os.Chtimes(dest, entry.ModTime, entry.ModTime)
+		}
+		return nil
+	})
+}
+
+// stageArchiveMember writes entry's content to a real file under memberDir
+// so tools that require a file path (Tika, ImageMagick, LibreOffice,
+// Tesseract) can read it, returning the staged file's path.
+func stageArchiveMember(memberDir string, entry ArchiveEntry, r io.Reader) (string, error) {
+	if err, _ := MakeDir(memberDir); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(memberDir, ".src-"+filepath.Base(entry.Name))
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error staging archive member %s, error message: %v", entry.Name, err)
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error staging archive member %s, error message: %v", entry.Name, err)
+	}
+	return tmp, nil
+}
+
+// walkArchiveMembers stages each regular file in input under
+// outdir/<member-path> and calls process with that member's directory and
+// staged file path, removing the staged file once process returns.
+func walkArchiveMembers(ctx context.Context, input, outdir string, process func(memberDir, staged string) error) error {
+	return WalkArchive(ctx, input, func(entry ArchiveEntry, r io.Reader) error {
+		memberDir := filepath.Join(outdir, filepath.FromSlash(entry.Name))
+		staged, err := stageArchiveMember(memberDir, entry, r)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(staged)
+		return process(memberDir, staged)
+	})
+}
+
+// puidFromExt makes a best-effort PUID guess from an archive member's file
+// extension, for use when no format identification is available for
+// individual members of an archive.
+func puidFromExt(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return "fmt/44"
+	case ".png":
+		return "fmt/13"
+	case ".tif", ".tiff":
+		return "fmt/353"
+	case ".gif":
+		return "fmt/4"
+	case ".bmp":
+		return "fmt/116"
+	case ".pdf":
+		return "fmt/18"
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 State of New South Wales through the State Archives and Records Authority of NSW
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wincommands
+
+import "testing"
+
+func TestSafeArchiveName(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain file", entry: "a/b/c.txt", want: "a/b/c.txt"},
+		{name: "backslash separators", entry: `a\b\c.txt`, want: "a/b/c.txt"},
+		{name: "empty name", entry: "", wantErr: true},
+		{name: "dot", entry: ".", wantErr: true},
+		{name: "absolute path", entry: "/etc/passwd", wantErr: true},
+		{name: "zip-slip traversal", entry: "../../etc/passwd", wantErr: true},
+		{name: "bare traversal", entry: "..", wantErr: true},
+		{name: "traversal in the middle stays contained", entry: "a/../b.txt", want: "b.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeArchiveName(tt.entry)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("safeArchiveName(%q) = %q, want error", tt.entry, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("safeArchiveName(%q) returned unexpected error: %v", tt.entry, err)
+			}
+			if got != tt.want {
+				t.Fatalf("safeArchiveName(%q) = %q, want %q", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeArchiveLink(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		target  string
+		wantErr bool
+	}{
+		{name: "empty target is ignored", entry: "a/b", target: ""},
+		{name: "relative sibling", entry: "a/b", target: "c"},
+		{name: "relative parent stays inside root", entry: "a/b/c", target: "../d"},
+		{name: "absolute target escapes", entry: "a/b", target: "/etc/passwd", wantErr: true},
+		{name: "relative target climbs above root", entry: "a/b", target: "../../../etc/passwd", wantErr: true},
+		{name: "target climbs one level above root", entry: "a", target: "..", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := safeArchiveLink(tt.entry, tt.target)
+			if tt.wantErr && err == nil {
+				t.Fatalf("safeArchiveLink(%q, %q) = nil, want error", tt.entry, tt.target)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("safeArchiveLink(%q, %q) returned unexpected error: %v", tt.entry, tt.target, err)
+			}
+		})
+	}
+}
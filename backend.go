@@ -0,0 +1,104 @@
+// Copyright 2018 State of New South Wales through the State Archives and Records Authority of NSW
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wincommands
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+)
+
+// tool names identify the external tool a command template invokes, so a
+// Backend can resolve argv[0] to either a local executable or a container
+// image without the rest of the template changing.
+const (
+	toolTika      = "tika"
+	toolConvert   = "convert"
+	toolSoffice   = "soffice"
+	toolFFmpeg    = "ffmpeg"
+	toolTesseract = "tesseract"
+	toolPdftoppm  = "pdftoppm"
+)
+
+// Backend runs a tool invocation built from argv (argv[0] is one of the
+// tool name constants above). LocalBackend runs it as a local subprocess;
+// DockerBackend runs it inside a pinned container. Implementations should
+// honour ctx cancellation.
+type Backend interface {
+	Run(ctx context.Context, argv []string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+var backend Backend = LocalBackend{}
+
+// SetBackend sets the Backend used to run Tika, LibreOffice, ImageMagick,
+// and ffmpeg commands. The default is LocalBackend, which requires each
+// tool to be installed at the path set by SetTikaPath, SetImageMPath,
+// SetLibreOPath, or SetFFMpegPath.
+func SetBackend(b Backend) {
+	backend = b
+}
+
+// localResolvers map a tool name to the local command line that invokes it,
+// given the remaining arguments. They read the install path variables
+// directly so SetTikaPath and friends keep working without also having to
+// rebuild a command template.
+var localResolvers = map[string]func([]string) []string{
+	toolTika:      func(a []string) []string { return append([]string{"java", "-jar", tikaInstall}, a...) },
+	toolConvert:   func(a []string) []string { return append([]string{imageMInstall}, a...) },
+	toolSoffice:   func(a []string) []string { return append([]string{libreOfficeInstall}, a...) },
+	toolFFmpeg:    func(a []string) []string { return append([]string{ffmpegInstall}, a...) },
+	toolTesseract: func(a []string) []string { return append([]string{tesseractInstall}, a...) },
+	toolPdftoppm:  func(a []string) []string { return append([]string{pdftoppmInstall}, a...) },
+}
+
+// LocalBackend runs commands as local subprocesses via os/exec. It is the
+// default Backend and preserves the module's original behaviour.
+type LocalBackend struct{}
+
+// Run implements Backend.
+func (LocalBackend) Run(ctx context.Context, argv []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	real := argv
+	if resolve, ok := localResolvers[argv[0]]; ok {
+		real = resolve(argv[1:])
+	}
+	cmd := exec.CommandContext(ctx, real[0], real[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// runBackend builds argv from template and custom, runs it on the current
+// Backend, and wires pr (if non-nil) up to the command's stdout and stderr
+// a line at a time.
+func runBackend(ctx context.Context, template []string, pr ProgressReporter, custom ...string) ([]byte, error) {
+	argv := make([]string, len(template)+len(custom))
+	copy(argv, template)
+	copy(argv[len(template):], custom)
+	var out bytes.Buffer
+	stdout := io.Writer(&out)
+	stderr := io.Writer(io.Discard)
+	if pr != nil {
+		stdout = io.MultiWriter(&out, &lineWriter{fn: pr.Stdout})
+		stderr = &lineWriter{fn: pr.Stderr}
+		pr.Started()
+	}
+	err := backend.Run(ctx, argv, nil, stdout, stderr)
+	if pr != nil {
+		pr.Finished(err)
+	}
+	return out.Bytes(), err
+}
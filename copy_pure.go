@@ -0,0 +1,149 @@
+// Copyright 2018 State of New South Wales through the State Archives and Records Authority of NSW
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build purecopy
+
+package wincommands
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// The choice between the shell-out backend (wincommands_unix.go,
+// wincommands_windows.go) and this native Go one is made at build time by
+// the purecopy build tag, not at runtime: build with -tags purecopy to get
+// FileCopy/FileCopyLog backed by nativeCopy instead of robocopy/xcopy/cp.
+
+// copyCmd describes the native copy as a pseudo-command purely so
+// FileCopyLog has something to log; it is never executed.
+func copyCmd(ctx context.Context, input, outdir string, quote bool) *exec.Cmd {
+	return exec.CommandContext(ctx, "nativecopy", input, outdir)
+}
+
+func fileCopy(ctx context.Context, input, outdir string, pr ProgressReporter) error {
+	output := filepath.Join(outdir, filepath.Base(input))
+	if pr != nil {
+		pr.Started()
+	}
+	_, err := nativeCopy(ctx, input, output)
+	if pr != nil {
+		pr.Finished(err)
+	}
+	return err
+}
+
+// FileCopyVerified copies input to outdir using the native pure-Go backend,
+// computing a SHA-256 digest of input while streaming it to the destination
+// and re-reading the destination to confirm the digest matches. It writes
+// the digest to a "<file>.sha256" sidecar next to output and also returns
+// it as a hex-encoded string. ctx cancels the copy between chunks.
+func FileCopyVerified(ctx context.Context, input, outdir string, overwrite bool) (string, error) {
+	output := filepath.Join(outdir, filepath.Base(input))
+	if handleOverwrite(overwrite, output) {
+		return "", nil
+	}
+	if err, _ := MakeDir(outdir); err != nil {
+		return "", err
+	}
+	digest, err := nativeCopy(ctx, input, output)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(output+".sha256", []byte(digest+"  "+filepath.Base(output)+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("Commands: Error writing sidecar digest for %s, error message: %v", output, err)
+	}
+	return digest, nil
+}
+
+// nativeCopy streams input to output through io.Copy, computing a SHA-256
+// digest as it goes, preserves the source file's mode and mtime, then
+// re-reads output to confirm the digest matches before returning it. ctx is
+// checked before every read, so cancelling it stops the copy between chunks
+// rather than only before it starts.
+func nativeCopy(ctx context.Context, input, output string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	in, err := os.Open(input)
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error opening %s, error message: %v", input, err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error stating %s, error message: %v", input, err)
+	}
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error creating %s, error message: %v", output, err)
+	}
+	srcHash := sha256.New()
+	_, err = io.Copy(out, io.TeeReader(&ctxReader{ctx, in}, srcHash))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error copying %s to %s, error message: %v", input, output, err)
+	}
+	if err := os.Chmod(output, info.Mode()); err != nil {
+		return "", fmt.Errorf("Commands: Error setting mode on %s, error message: %v", output, err)
+	}
+	if err := os.Chtimes(output, info.ModTime(), info.ModTime()); err != nil {
+		return "", fmt.Errorf("Commands: Error setting mtime on %s, error message: %v", output, err)
+	}
+	digest := hex.EncodeToString(srcHash.Sum(nil))
+	dstHash, err := hashFile(output)
+	if err != nil {
+		return "", err
+	}
+	if dstHash != digest {
+		return "", fmt.Errorf("Commands: Error verifying copy of %s to %s: digest mismatch, source %s dest %s", input, output, digest, dstHash)
+	}
+	return digest, nil
+}
+
+// ctxReader wraps an io.Reader so ctx is checked on every Read call, giving
+// io.Copy a way to stop partway through a large copy instead of only before
+// it starts.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error opening %s, error message: %v", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("Commands: Error hashing %s, error message: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
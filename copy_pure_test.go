@@ -0,0 +1,115 @@
+// Copyright 2018 State of New South Wales through the State Archives and Records Authority of NSW
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build purecopy
+
+package wincommands
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNativeCopy(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "src.txt")
+	content := []byte("hello wincommands")
+	if err := os.WriteFile(input, content, 0644); err != nil {
+		t.Fatalf("writing source file: %v", err)
+	}
+	if err := os.Chmod(input, 0640); err != nil {
+		t.Fatalf("chmod source file: %v", err)
+	}
+
+	output := filepath.Join(dir, "dst.txt")
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+
+	digest, err := nativeCopy(context.Background(), input, output)
+	if err != nil {
+		t.Fatalf("nativeCopy: %v", err)
+	}
+	if digest != want {
+		t.Fatalf("nativeCopy digest = %s, want %s", digest, want)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("reading copied file: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("copied content = %q, want %q", got, content)
+	}
+}
+
+func TestNativeCopyChmodsExistingDestination(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "src.txt")
+	content := []byte("overwrite me")
+	if err := os.WriteFile(input, content, 0640); err != nil {
+		t.Fatalf("writing source file: %v", err)
+	}
+
+	output := filepath.Join(dir, "dst.txt")
+	if err := os.WriteFile(output, []byte("stale"), 0600); err != nil {
+		t.Fatalf("writing existing destination: %v", err)
+	}
+
+	if _, err := nativeCopy(context.Background(), input, output); err != nil {
+		t.Fatalf("nativeCopy: %v", err)
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		t.Fatalf("stating destination: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("destination mode = %v, want %v", info.Mode().Perm(), os.FileMode(0640))
+	}
+}
+
+func TestNativeCopyContextCancelled(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(input, []byte("data"), 0644); err != nil {
+		t.Fatalf("writing source file: %v", err)
+	}
+	output := filepath.Join(dir, "dst.txt")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := nativeCopy(ctx, input, output); err == nil {
+		t.Fatal("nativeCopy with a cancelled context returned nil error, want one")
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.txt")
+	content := []byte("digest me")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+	got, err := hashFile(path)
+	if err != nil {
+		t.Fatalf("hashFile: %v", err)
+	}
+	if got != want {
+		t.Fatalf("hashFile = %s, want %s", got, want)
+	}
+}
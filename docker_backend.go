@@ -0,0 +1,321 @@
+// Copyright 2018 State of New South Wales through the State Archives and Records Authority of NSW
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wincommands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Docker image defaults, one per tool name constant.
+var (
+	tikaImage         = "apache/tika"
+	imageMImage       = "dpokidov/imagemagick"
+	libreOfficeImage  = "linuxserver/libreoffice"
+	ffmpegImage       = "jrottenberg/ffmpeg"
+	tesseractOCRImage = "jitesoft/tesseract-ocr"
+	pdftoppmOCRImage  = "minidocks/poppler"
+
+	dockerImages = map[string]*string{
+		toolTika:      &tikaImage,
+		toolConvert:   &imageMImage,
+		toolSoffice:   &libreOfficeImage,
+		toolFFmpeg:    &ffmpegImage,
+		toolTesseract: &tesseractOCRImage,
+		toolPdftoppm:  &pdftoppmOCRImage,
+	}
+)
+
+// SetTikaImage sets the container image DockerBackend uses to run Tika
+func SetTikaImage(image string) { tikaImage = image }
+
+// SetImageMImage sets the container image DockerBackend uses to run ImageMagick
+func SetImageMImage(image string) { imageMImage = image }
+
+// SetLibreOImage sets the container image DockerBackend uses to run LibreOffice
+func SetLibreOImage(image string) { libreOfficeImage = image }
+
+// SetFFMpegImage sets the container image DockerBackend uses to run ffmpeg
+func SetFFMpegImage(image string) { ffmpegImage = image }
+
+// SetTesseractImage sets the container image DockerBackend uses to run Tesseract
+func SetTesseractImage(image string) { tesseractOCRImage = image }
+
+// SetPdftoppmImage sets the container image DockerBackend uses to run pdftoppm
+func SetPdftoppmImage(image string) { pdftoppmOCRImage = image }
+
+// DockerBackend runs Tika, LibreOffice, ImageMagick, and ffmpeg commands
+// inside pinned containers via the Docker Engine API, instead of requiring
+// each tool to be installed on the host. Every host directory referenced in
+// a command's arguments is bind-mounted unchanged into the container, so
+// commands see the same paths they would running locally.
+type DockerBackend struct {
+	// Host is the path to the Docker Engine API's unix socket. Empty uses
+	// the default, /var/run/docker.sock.
+	Host string
+}
+
+func (d DockerBackend) socket() string {
+	if d.Host != "" {
+		return d.Host
+	}
+	return "/var/run/docker.sock"
+}
+
+func (d DockerBackend) client() *http.Client {
+	sock := d.socket()
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+}
+
+// Run implements Backend by running argv inside the image registered for
+// the tool named in argv[0] (see SetTikaImage, SetImageMImage,
+// SetLibreOImage, SetFFMpegImage).
+func (d DockerBackend) Run(ctx context.Context, argv []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(argv) == 0 {
+		return fmt.Errorf("Commands: Error running Docker command, error message: empty command")
+	}
+	img, ok := dockerImages[argv[0]]
+	if !ok {
+		return fmt.Errorf("Commands: Error running Docker command, error message: no image configured for tool %s", argv[0])
+	}
+	args := argv[1:]
+	var binds []string
+	for _, dir := range hostDirs(args) {
+		binds = append(binds, fmt.Sprintf("%s:%s", dir, dir))
+	}
+	client := d.client()
+	id, err := d.createContainer(ctx, client, *img, args, binds, stdin != nil)
+	if err != nil {
+		return err
+	}
+	defer d.removeContainer(id)
+	if err := d.attachAndStart(ctx, id, stdin, stdout, stderr); err != nil {
+		return err
+	}
+	return d.wait(ctx, client, id)
+}
+
+// hostDirs returns the distinct, existing host directories referenced by
+// args, so they can be bind-mounted into the container.
+func hostDirs(args []string) []string {
+	seen := map[string]bool{}
+	var dirs []string
+	for _, a := range args {
+		p := strings.TrimSuffix(a, "[0]") // ImageMagick's page-selector suffix, e.g. in Thumbnail
+		dir := filepath.Dir(p)
+		if dir == "." || seen[dir] {
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func (d DockerBackend) createContainer(ctx context.Context, client *http.Client, image string, args, binds []string, openStdin bool) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"Image":        image,
+		"Cmd":          args,
+		"AttachStdin":  openStdin,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"OpenStdin":    openStdin,
+		"Tty":          false,
+		"HostConfig": map[string]interface{}{
+			"Binds": binds,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error building Docker create request for %s, error message: %v", image, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://docker/containers/create", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Commands: Error creating Docker container for %s, error message: %v", image, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Commands: Error creating Docker container for %s, error message: %s", image, dockerErr(resp))
+	}
+	var out struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("Commands: Error decoding Docker create response for %s, error message: %v", image, err)
+	}
+	return out.ID, nil
+}
+
+// attachAndStart attaches to the container's stdio before starting it, so
+// no output is missed, then demultiplexes the attach stream into stdout and
+// stderr until the container closes the connection.
+func (d DockerBackend) attachAndStart(ctx context.Context, id string, stdin io.Reader, stdout, stderr io.Writer) error {
+	conn, br, err := d.hijackAttach(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://docker/containers/%s/start", id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("Commands: Error starting Docker container %s, error message: %v", id, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Commands: Error starting Docker container %s, error message: status %s", id, resp.Status)
+	}
+	if stdin != nil {
+		go func() {
+			io.Copy(conn, stdin)
+			if c, ok := conn.(interface{ CloseWrite() error }); ok {
+				c.CloseWrite()
+			}
+		}()
+	}
+	return demuxDockerStream(br, stdout, stderr)
+}
+
+// hijackAttach dials the Docker socket directly and issues the attach
+// request by hand, since the stream that follows the HTTP response isn't
+// something net/http's Client can hand back to us.
+func (d DockerBackend) hijackAttach(ctx context.Context, id string) (net.Conn, *bufio.Reader, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", d.socket())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Commands: Error connecting to Docker socket %s, error message: %v", d.socket(), err)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("/containers/%s/attach?stream=1&stdout=1&stderr=1&stdin=1", id), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Host = "docker"
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Commands: Error attaching to Docker container %s, error message: %v", id, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Commands: Error reading Docker attach response for %s, error message: %v", id, err)
+	}
+	if resp.StatusCode >= 300 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Commands: Error attaching to Docker container %s, error message: status %s", id, resp.Status)
+	}
+	return conn, br, nil
+}
+
+// demuxDockerStream reads Docker's multiplexed attach stream - each frame is
+// an 8 byte header (stream type, 3 unused bytes, big-endian payload size)
+// followed by the payload - and writes each frame's payload to stdout or
+// stderr according to its stream type.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("Commands: Error reading Docker attach stream, error message: %v", err)
+		}
+		size := binary.BigEndian.Uint32(hdr[4:8])
+		w := stdout
+		if hdr[0] == 2 {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, r, int64(size)); err != nil {
+			return fmt.Errorf("Commands: Error reading Docker attach stream, error message: %v", err)
+		}
+	}
+}
+
+func (d DockerBackend) wait(ctx context.Context, client *http.Client, id string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://docker/containers/%s/wait", id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Commands: Error waiting on Docker container %s, error message: %v", id, err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("Commands: Error decoding Docker wait response for %s, error message: %v", id, err)
+	}
+	if out.Error != nil && out.Error.Message != "" {
+		return fmt.Errorf("Commands: Error running Docker container %s, error message: %s", id, out.Error.Message)
+	}
+	if out.StatusCode != 0 {
+		return fmt.Errorf("Commands: Error running Docker container %s, error message: exit status %d", id, out.StatusCode)
+	}
+	return nil
+}
+
+func (d DockerBackend) removeContainer(id string) {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://docker/containers/%s?force=1", id), nil)
+	if err != nil {
+		return
+	}
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+func dockerErr(resp *http.Response) string {
+	var e struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err == nil && e.Message != "" {
+		return e.Message
+	}
+	return resp.Status
+}
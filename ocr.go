@@ -0,0 +1,142 @@
+// Copyright 2018 State of New South Wales through the State Archives and Records Authority of NSW
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wincommands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// OCR defaults
+
+var (
+	tesseractInstall = "tesseract"
+	pdftoppmInstall  = "pdftoppm"
+	ocrLanguages     = "eng"
+	ocrDPI           = 300
+	ocrThreshold     = 16 // minimum bytes Tika must extract before ExtractText skips the OCR fallback
+
+	// tesseract and pdftoppm are built from the tool name constants rather
+	// than the install paths above, so the Backend in use (LocalBackend or
+	// DockerBackend) decides how each tool is actually invoked.
+	tesseract = []string{toolTesseract}
+	pdftoppm  = []string{toolPdftoppm}
+)
+
+// SetTesseractPath sets your install directory for Tesseract, used by LocalBackend
+func SetTesseractPath(p string) {
+	tesseractInstall = p
+}
+
+// SetOCRLanguages sets the Tesseract language code(s), e.g. "eng" or "eng+fra", used by the OCR fallback
+func SetOCRLanguages(l string) {
+	ocrLanguages = l
+}
+
+// SetOCRDPI sets the resolution, in dots per inch, that PDF pages are rasterized at before OCR
+func SetOCRDPI(dpi int) {
+	ocrDPI = dpi
+}
+
+// SetOCRThreshold sets the minimum number of bytes Tika must extract from a
+// document before ExtractText considers the result good enough and skips
+// the OCR fallback.
+func SetOCRThreshold(n int) {
+	ocrThreshold = n
+}
+
+// ExtractTextOCR extracts text from input via the OCR pipeline (Tesseract,
+// rasterizing first with pdftoppm if input is a PDF) and writes it to
+// outname in outdir, bypassing Tika entirely. puid is the PRONOM identifier
+// of input, used to decide whether to OCR it directly as an image or
+// rasterize it first as a PDF.
+func ExtractTextOCR(ctx context.Context, input, outdir, outname string, overwrite bool, puid string, pr ProgressReporter) error {
+	output := filepath.Join(outdir, outname)
+	if handleOverwrite(overwrite, output) {
+		return nil
+	}
+	if err, _ := MakeDir(outdir); err != nil {
+		return err
+	}
+	ctx, cancel := ctxWithTimeout(ctx)
+	defer cancel()
+	txt, err := ocrExtract(ctx, input, puid, pr)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(output, txt, os.ModePerm); err != nil {
+		return fmt.Errorf("Commands: Error writing to %s, error message: %v", output, err)
+	}
+	return nil
+}
+
+// ocrExtract OCRs input, dispatching to the image or PDF pipeline depending
+// on puid.
+func ocrExtract(ctx context.Context, input, puid string, pr ProgressReporter) ([]byte, error) {
+	switch {
+	case IsImage(puid):
+		return tesseractImage(ctx, input, pr)
+	case IsPDF(puid):
+		return tesseractPDF(ctx, input, pr)
+	}
+	return nil, fmt.Errorf("Commands: Error running OCR on %s, error message: unsupported format %s for OCR", input, puid)
+}
+
+// tesseractImage pipes input directly to Tesseract and returns its text.
+func tesseractImage(ctx context.Context, input string, pr ProgressReporter) ([]byte, error) {
+	txt, err := runBackend(ctx, tesseract, pr, input, "-", "-l", ocrLanguages)
+	if err != nil {
+		return nil, fmt.Errorf("Commands: Error running tesseract on %s, error message: %v", input, err)
+	}
+	return txt, nil
+}
+
+// tesseractPDF rasterizes each page of input with pdftoppm, OCRs each page
+// image with Tesseract, and concatenates the page texts with form feed
+// separators.
+func tesseractPDF(ctx context.Context, input string, pr ProgressReporter) ([]byte, error) {
+	tmpDir, err := ioutil.TempDir("", "wincommands-ocr")
+	if err != nil {
+		return nil, fmt.Errorf("Commands: Error creating OCR temp dir for %s, error message: %v", input, err)
+	}
+	defer os.RemoveAll(tmpDir)
+	prefix := filepath.Join(tmpDir, "page")
+	if _, err := runBackend(ctx, pdftoppm, pr, "-r", strconv.Itoa(ocrDPI), "-png", input, prefix); err != nil {
+		return nil, fmt.Errorf("Commands: Error rasterizing %s, error message: %v", input, err)
+	}
+	pages, err := filepath.Glob(prefix + "-*.png")
+	if err != nil || len(pages) == 0 {
+		return nil, fmt.Errorf("Commands: Error rasterizing %s, error message: no pages produced", input)
+	}
+	sort.Strings(pages)
+	var out bytes.Buffer
+	for i, page := range pages {
+		if i > 0 {
+			out.WriteByte('\f')
+		}
+		txt, err := tesseractImage(ctx, page, pr)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(txt)
+	}
+	return out.Bytes(), nil
+}
@@ -15,6 +15,8 @@
 package wincommands
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -35,70 +37,125 @@ var (
 	thumbDimensions    = "1024x1024"
 	timeout            = 30 * time.Second
 
-	extract = []string{"java", "-jar", tikaInstall, "-t"}
-	thumb   = []string{imageMInstall, "-resize", thumbDimensions, "-flatten", "-quality", "100"}
-	pdf     = []string{libreOfficeInstall, "--headless", "--convert-to", "pdf:writer_pdf_Export", "--outdir"}
-	ffmpeg  = []string{ffmpegInstall}
+	// extract, thumb, and pdf are built from the tool name constants rather
+	// than the install paths above, so the Backend in use (LocalBackend or
+	// DockerBackend) decides how each tool is actually invoked.
+	extract = []string{toolTika, "-t"}
+	thumb   = []string{toolConvert, "-monitor", "-resize", thumbDimensions, "-flatten", "-quality", "100"}
+	pdf     = []string{toolSoffice, "--headless", "--convert-to", "pdf:writer_pdf_Export", "--outdir"}
 )
 
-// SetFFMpegPath sets your install directory for FFMpeg
+// SetFFMpegPath sets your install directory for FFMpeg, used by LocalBackend
 func SetFFMpegPath(p string) {
 	ffmpegInstall = p
-	ffmpeg = []string{ffmpegInstall}
 }
 
-// SetTikaPath sets your install directory for Tika
+// SetTikaPath sets your install directory for Tika, used by LocalBackend
 func SetTikaPath(p string) {
 	tikaInstall = p
-	extract = []string{"java", "-jar", tikaInstall, "-t"}
 }
 
-// SetImageMPath sets your install directory for Image Magick
+// SetImageMPath sets your install directory for Image Magick, used by LocalBackend
 func SetImageMPath(p string) {
 	imageMInstall = p
-	thumb = []string{imageMInstall, "-resize", thumbDimensions, "-flatten", "-quality", "100"}
 }
 
-// SetLibreOPath sets your install directory for Libre Office
+// SetLibreOPath sets your install directory for Libre Office, used by LocalBackend
 func SetLibreOPath(p string) {
 	libreOfficeInstall = p
-	pdf = []string{libreOfficeInstall, "--headless", "--convert-to", "pdf:writer_pdf_Export", "--outdir"}
 }
 
 // SetThumb defines your preferences for thumbnail dimensions (provide x and y values)
 func SetThumb(x, y int) {
 	thumbDimensions = fmt.Sprintf("%dx%d", x, y)
-	thumb = []string{imageMInstall, "-resize", thumbDimensions, "-flatten", "-quality", "100"}
+	thumb = []string{toolConvert, "-monitor", "-resize", thumbDimensions, "-flatten", "-quality", "100"}
 }
 
-// SetTimeout sets a timeout for actions
+// SetTimeout sets a timeout for actions. It is used as the default deadline
+// applied to a context.Context passed to ExtractText, Thumbnail, or
+// WordToPdf that does not already have one.
 func SetTimeout(t time.Duration) {
 	timeout = t
 }
 
+// ProgressReporter receives progress events as a command runs. Started is
+// called once as the command begins (commands run through a Backend report
+// it just before the Backend launches them, so a launch failure there is
+// reported as Started followed by Finished with the error), Stdout and Stderr
+// are called once per line of output the tool scrapes (robocopy's
+// percentage lines, ffmpeg's out_time_ms=..., and so on), and Finished is
+// called once with the final error, if any, once the process has exited.
+// Implementations must be safe to call from multiple goroutines.
+type ProgressReporter interface {
+	Started()
+	Stdout(line string)
+	Stderr(line string)
+	Finished(err error)
+}
+
 // commands
 
-func buildCmd(template []string, custom ...string) *exec.Cmd {
+// ctxWithTimeout returns ctx unchanged if it already carries a deadline,
+// otherwise it returns a derived context bounded by the package timeout.
+func ctxWithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func buildCmd(ctx context.Context, template []string, custom ...string) *exec.Cmd {
 	cmd := make([]string, len(template)+len(custom))
 	copy(cmd, template)
 	copy(cmd[len(template):], custom)
-	return exec.Command(cmd[0], cmd[1:]...)
+	return exec.CommandContext(ctx, cmd[0], cmd[1:]...)
 }
 
-func timeOutRun(cmd *exec.Cmd, dur time.Duration) error {
-	err := cmd.Start()
-	if err != nil {
-		return err
+// lineWriter splits whatever is written to it into lines, reporting each
+// complete line to fn. Partial lines are buffered until the next write.
+type lineWriter struct {
+	buf []byte
+	fn  func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(string(bytes.TrimRight(w.buf[:i], "\r")))
+		w.buf = w.buf[i+1:]
 	}
-	timer := time.AfterFunc(dur, func() {
-		e := cmd.Process.Kill()
-		if e != nil {
-			panic(e)
+	return len(p), nil
+}
+
+// runCmd starts cmd, wiring its stdout and stderr to pr (if non-nil) a line
+// at a time, waits for it to finish, and returns the captured stdout.
+// Cancelling ctx (the one used to build cmd) kills the process.
+func runCmd(cmd *exec.Cmd, pr ProgressReporter) ([]byte, error) {
+	var out bytes.Buffer
+	stdout := io.Writer(&out)
+	if pr != nil {
+		stdout = io.MultiWriter(&out, &lineWriter{fn: pr.Stdout})
+		cmd.Stderr = &lineWriter{fn: pr.Stderr}
+	}
+	cmd.Stdout = stdout
+	if err := cmd.Start(); err != nil {
+		if pr != nil {
+			pr.Finished(err)
 		}
-	})
-	err = cmd.Wait()
-	timer.Stop()
-	return err
+		return nil, err
+	}
+	if pr != nil {
+		pr.Started()
+	}
+	err := cmd.Wait()
+	if pr != nil {
+		pr.Finished(err)
+	}
+	return out.Bytes(), err
 }
 
 func handleOverwrite(overwrite bool, output string) bool {
@@ -122,8 +179,19 @@ func MakeDir(dir string) (error, bool) {
 	return fmt.Errorf("Commands: Error making directory %s, error message: %v", dir, err), false
 }
 
-// ExtractText extracts text from input and writes it to the outname in outdir
-func ExtractText(input, outdir, outname string, overwrite bool) error {
+// ExtractText extracts text from input and writes it to the outname in
+// outdir. ctx cancels the underlying Tika process; pr, if non-nil, receives
+// progress events as Tika runs. If Tika returns less than the OCR threshold
+// (see SetOCRThreshold) and puid identifies an image or a PDF, ExtractText
+// falls back to OCRing input via Tesseract before giving up. If input is an
+// archive (see IsArchive), ExtractText instead extracts text from every
+// member, writing each member's outname under outdir/<member-path>.
+func ExtractText(ctx context.Context, input, outdir, outname string, overwrite bool, puid string, pr ProgressReporter) error {
+	if IsArchive(input) {
+		return walkArchiveMembers(ctx, input, outdir, func(memberDir, staged string) error {
+			return ExtractText(ctx, staged, memberDir, outname, overwrite, puidFromExt(staged), pr)
+		})
+	}
 	output := filepath.Join(outdir, outname)
 	if handleOverwrite(overwrite, output) {
 		return nil
@@ -131,27 +199,45 @@ func ExtractText(input, outdir, outname string, overwrite bool) error {
 	if err, _ := MakeDir(outdir); err != nil {
 		return err
 	}
-	tikaCmd := buildCmd(extract, input)
-	txt, err := tikaCmd.Output()
-	if err != nil {
+	ctx, cancel := ctxWithTimeout(ctx)
+	defer cancel()
+	txt, err := runBackend(ctx, extract, pr, input)
+	if err != nil || len(txt) < ocrThreshold {
+		if IsImage(puid) || IsPDF(puid) {
+			if ocrTxt, ocrErr := ocrExtract(ctx, input, puid, pr); ocrErr == nil {
+				txt = ocrTxt
+			}
+		}
+	}
+	if len(txt) == 0 {
 		return nil // :( no text
 		// return fmt.Errorf("Commands: Error making text from %s, error message: %v", input, err)
 	}
-	err = ioutil.WriteFile(output, txt, os.ModePerm)
-	if err != nil {
+	if err := ioutil.WriteFile(output, txt, os.ModePerm); err != nil {
 		return fmt.Errorf("Commands: Error writing to %s, error message: %v", output, err)
 	}
 	return nil
 }
 
-// Thumbnail creates a thumbnail of input in outname in outdir
-func Thumbnail(input, outdir, outname string, overwrite bool) error {
+// Thumbnail creates a thumbnail of input in outname in outdir. ctx cancels
+// the underlying ImageMagick process; pr, if non-nil, receives progress
+// events (ImageMagick is run with -monitor). If input is an archive (see
+// IsArchive), Thumbnail instead thumbnails every member, writing each
+// member's outname under outdir/<member-path>.
+func Thumbnail(ctx context.Context, input, outdir, outname string, overwrite bool, pr ProgressReporter) error {
+	if IsArchive(input) {
+		return walkArchiveMembers(ctx, input, outdir, func(memberDir, staged string) error {
+			return Thumbnail(ctx, staged, memberDir, outname, overwrite, pr)
+		})
+	}
 	output := filepath.Join(outdir, outname)
 	if handleOverwrite(overwrite, output) {
 		return nil
 	}
-	thumbCmd := buildCmd(thumb, input+"[0]", output)
-	return timeOutRun(thumbCmd, timeout)
+	ctx, cancel := ctxWithTimeout(ctx)
+	defer cancel()
+	_, err := runBackend(ctx, thumb, pr, input+"[0]", output)
+	return err
 }
 
 func quotePath(path string) string {
@@ -164,8 +250,11 @@ func quotePath(path string) string {
 	return path
 }
 
-// FileCopy uses robocopy to copy a file input to outdir
-func FileCopy(input, outdir string, overwrite bool) error {
+// FileCopy copies a file input to outdir, using robocopy on Windows, cp
+// elsewhere, or the native Go copy when built with the purecopy tag. ctx
+// cancels the underlying copy; pr, if non-nil, receives progress events as
+// it runs (robocopy emits percentage lines).
+func FileCopy(ctx context.Context, input, outdir string, overwrite bool, pr ProgressReporter) error {
 	output := filepath.Join(outdir, filepath.Base(input))
 	if handleOverwrite(overwrite, output) {
 		return nil
@@ -173,11 +262,13 @@ func FileCopy(input, outdir string, overwrite bool) error {
 	if err, _ := MakeDir(outdir); err != nil {
 		return err
 	}
-	return fileCopy(input, outdir)
+	return fileCopy(ctx, input, outdir, pr)
 }
 
-// FileCopy log copies a file from input to outdir using xcopy and logs the copy action to the provided log writer
-func FileCopyLog(lg io.Writer, input, outdir string, overwrite bool) error {
+// FileCopyLog creates outdir and writes to the provided log writer the command line (xcopy on Windows) that would copy input to outdir.
+// pr is accepted for symmetry with FileCopy, but FileCopyLog never runs the
+// copy itself, so pr receives no events.
+func FileCopyLog(ctx context.Context, lg io.Writer, input, outdir string, overwrite bool, pr ProgressReporter) error {
 	output := filepath.Join(outdir, filepath.Base(input))
 	if handleOverwrite(overwrite, output) {
 		return nil
@@ -185,13 +276,25 @@ func FileCopyLog(lg io.Writer, input, outdir string, overwrite bool) error {
 	if err, _ := MakeDir(outdir); err != nil {
 		return err
 	}
-	cpCmd := copyCmd(input, outdir, true)
+	cpCmd := copyCmd(ctx, input, outdir, true)
 	_, err := fmt.Fprintln(lg, strings.Join(cpCmd.Args, " "))
 	return err
 }
 
-// WordToPdf turns a word doc at input into a PDF file in outdir
-func WordToPdf(input, outdir string, overwrite bool) (string, error) {
+// WordToPdf turns a word doc at input into a PDF file in outdir. ctx cancels
+// the underlying LibreOffice process; pr, if non-nil, receives progress
+// events as LibreOffice runs. If input is an archive (see IsArchive),
+// WordToPdf instead converts each member in turn under outdir/<member-path>
+// and returns outdir; the walk stops at the first member that returns an
+// error, and that error is returned with outdir.
+func WordToPdf(ctx context.Context, input, outdir string, overwrite bool, pr ProgressReporter) (string, error) {
+	if IsArchive(input) {
+		err := walkArchiveMembers(ctx, input, outdir, func(memberDir, staged string) error {
+			_, err := WordToPdf(ctx, staged, memberDir, overwrite, pr)
+			return err
+		})
+		return outdir, err
+	}
 	var output string
 	switch filepath.Ext(input) {
 	case ".doc", ".DOC", ".docx", ".DOCX", ".dotx", ".DOTX", ".docm", ".DOCM":
@@ -206,8 +309,9 @@ func WordToPdf(input, outdir string, overwrite bool) (string, error) {
 	if err, _ := MakeDir(outdir); err != nil {
 		return "", err
 	}
-	pdfCmd := buildCmd(pdf, outdir, input)
-	_ = timeOutRun(pdfCmd, timeout)
+	ctx, cancel := ctxWithTimeout(ctx)
+	defer cancel()
+	_, _ = runBackend(ctx, pdf, pr, outdir, input)
 	if _, err := os.Stat(output); err != nil {
 		e := os.RemoveAll(outdir) // failed to create, cleanup
 		if e != nil {
@@ -236,6 +340,15 @@ func IsPDF(puid string) bool {
 	return false
 }
 
+// IsImage tests a PUID against common raster image formats
+func IsImage(puid string) bool {
+	switch puid {
+	case "fmt/3", "fmt/4", "fmt/11", "fmt/12", "fmt/13", "fmt/41", "fmt/42", "fmt/43", "fmt/44", "fmt/116", "fmt/152", "fmt/153", "fmt/154", "fmt/155", "fmt/156", "x-fmt/270":
+		return true
+	}
+	return false
+}
+
 // IsText tests a PUID against the text formats
 func IsText(puid string) bool {
 	switch puid {
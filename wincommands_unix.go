@@ -1,6 +1,9 @@
+//go:build !windows && !purecopy
+
 package wincommands
 
 import (
+	"context"
 	"os/exec"
 )
 
@@ -8,11 +11,12 @@ var (
 	cp = []string{"cp"}
 )
 
-func copyCmd(input, outdir string, quote bool) *exec.Cmd {
-	return buildCmd(cp, input, outdir)
+func copyCmd(ctx context.Context, input, outdir string, quote bool) *exec.Cmd {
+	return buildCmd(ctx, cp, input, outdir)
 }
 
-func fileCopy(input, outdir string) error {
-	cmd := copyCmd(input, outdir, false)
-	return cmd.Run()
+func fileCopy(ctx context.Context, input, outdir string, pr ProgressReporter) error {
+	cmd := copyCmd(ctx, input, outdir, false)
+	_, err := runCmd(cmd, pr)
+	return err
 }
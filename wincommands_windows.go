@@ -1,8 +1,13 @@
+//go:build !purecopy
+
 package wincommands
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 var (
@@ -10,17 +15,17 @@ var (
 	xcp = []string{"xcopy"}
 )
 
-func fileCopy(input, outdir) error {
-	return runRobo(input, outdir)
+func fileCopy(ctx context.Context, input, outdir string, pr ProgressReporter) error {
+	return runRobo(ctx, input, outdir, pr)
 }
 
-func copyCmd(input, outdir string, quote bool) *exec.Cmd {
-	return xcopy(input, outdir, quote)
+func copyCmd(ctx context.Context, input, outdir string, quote bool) *exec.Cmd {
+	return xcopy(ctx, input, outdir, quote)
 }
 
-func runRobo(input, outdir string) error {
-	cpCmd := robo(input, outdir, false)
-	err := cpCmd.Run()
+func runRobo(ctx context.Context, input, outdir string, pr ProgressReporter) error {
+	cpCmd := robo(ctx, input, outdir, false)
+	_, err := runCmd(cpCmd, pr)
 	if err == nil {
 		return fmt.Errorf("Commands: Error copying %s to %s with command %s, error message: No errors occurred and no files were copied", input, outdir, strings.Join(append([]string{cpCmd.Path}, cpCmd.Args...), " "))
 	}
@@ -30,7 +35,7 @@ func runRobo(input, outdir string) error {
 	return fmt.Errorf("Commands: Error copying %s to %s with command %s, error message: %v", input, outdir, strings.Join(append([]string{cpCmd.Path}, cpCmd.Args...), " "), err)
 }
 
-func robo(input, outdir string, quote bool) *exec.Cmd {
+func robo(ctx context.Context, input, outdir string, quote bool) *exec.Cmd {
 	dir, fn := filepath.Split(input)
 	if len(dir) > 0 {
 		dir = dir[:len(dir)-1]
@@ -38,19 +43,19 @@ func robo(input, outdir string, quote bool) *exec.Cmd {
 	if quote {
 		dir, outdir, fn = quotePath(dir), quotePath(outdir), quotePath(fn)
 	}
-	return buildCmd(rcp, dir, outdir, fn)
+	return buildCmd(ctx, rcp, dir, outdir, fn)
 }
 
-func xcopy(input, outdir string, quote bool) *exec.Cmd {
+func xcopy(ctx context.Context, input, outdir string, quote bool) *exec.Cmd {
 	if quote {
 		input, outdir = quotePath(input), quotePath(outdir)
 	}
-	return buildCmd(xcp, input, outdir)
+	return buildCmd(ctx, xcp, input, outdir)
 }
 
-func runXcopy(input, outdir string) error {
-	cpCmd := xcopy(input, outdir, false)
-	err := cpCmd.Run()
+func runXcopy(ctx context.Context, input, outdir string, pr ProgressReporter) error {
+	cpCmd := xcopy(ctx, input, outdir, false)
+	_, err := runCmd(cpCmd, pr)
 	if err == nil {
 		return nil
 	}